@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	// DefaultChunkSize is the default size of a single cached block, in bytes
+	DefaultChunkSize = 1024 * 1024
+	// DefaultChunkCacheSize is the default total size budget for cached blocks
+	DefaultChunkCacheSize = 10 * 1024 * 1024 * 1024
+
+	blockCacheGCInterval = 1 * time.Minute
+)
+
+// BlockCache is a read-through cache for downloaded byte ranges, keyed by
+// (ObjectID, block index) and evicted least-recently-used
+type BlockCache struct {
+	basePath       string
+	chunkSize      int64
+	chunkCacheSize int64
+
+	mutex       sync.Mutex
+	currentSize int64
+	lru         *list.List
+	entries     map[string]*list.Element
+}
+
+type blockCacheEntry struct {
+	key     string
+	size    int64
+	touched time.Time
+}
+
+// NewBlockCache creates a new chunk-level block cache rooted at
+// cacheBasePath/chunks and registers it as metaCache's purge hook
+func NewBlockCache(cacheBasePath string, chunkSize, chunkCacheSize int64, metaCache Cache) (*BlockCache, error) {
+	basePath := filepath.Join(cacheBasePath, "chunks")
+	if err := os.MkdirAll(basePath, 0755); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create chunk cache directory %v", basePath)
+	}
+
+	cache := &BlockCache{
+		basePath:       basePath,
+		chunkSize:      chunkSize,
+		chunkCacheSize: chunkCacheSize,
+		lru:            list.New(),
+		entries:        make(map[string]*list.Element),
+	}
+
+	if err := cache.loadExisting(); nil != err {
+		Log.Debugf("%v", err)
+	}
+
+	go cache.startGC()
+
+	metaCache.SetPurgeHook(func(objectID string) {
+		if err := cache.PurgeObject(objectID); nil != err {
+			Log.Debugf("%v", err)
+		}
+	})
+
+	return cache, nil
+}
+
+func (c *BlockCache) loadExisting() error {
+	return filepath.Walk(c.basePath, func(path string, info os.FileInfo, err error) error {
+		if nil != err {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		key, err := filepath.Rel(c.basePath, path)
+		if nil != err {
+			return err
+		}
+		key = filepath.ToSlash(key)
+
+		c.mutex.Lock()
+		c.currentSize += info.Size()
+		c.lru.PushFront(&blockCacheEntry{key: key, size: info.Size(), touched: info.ModTime()})
+		c.entries[key] = c.lru.Front()
+		c.mutex.Unlock()
+		return nil
+	})
+}
+
+// blockKey builds the cache key (and, via blockPath, the on-disk path) for a block
+func blockKey(objectID string, idx int64) string {
+	return objectID + "/" + strconv.FormatInt(idx, 10)
+}
+
+func (c *BlockCache) blockPath(key string) string {
+	return filepath.Join(c.basePath, key)
+}
+
+// GetBlock returns the cached bytes for the given block, if present
+func (c *BlockCache) GetBlock(objectID string, idx int64) ([]byte, bool) {
+	key := blockKey(objectID, idx)
+
+	data, err := ioutil.ReadFile(c.blockPath(key))
+	if nil != err {
+		return nil, false
+	}
+
+	c.touch(key)
+	Log.Tracef("Block cache hit for %v block %v", objectID, idx)
+	return data, true
+}
+
+// PutBlock stores a downloaded block in the cache, evicting older blocks if
+// the total cache size would exceed chunkCacheSize
+func (c *BlockCache) PutBlock(objectID string, idx int64, data []byte) error {
+	key := blockKey(objectID, idx)
+	path := c.blockPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not create chunk cache directory for %v", key)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write chunk cache block %v", key)
+	}
+
+	c.mutex.Lock()
+	if existing, ok := c.entries[key]; ok {
+		c.currentSize -= existing.Value.(*blockCacheEntry).size
+		c.lru.Remove(existing)
+	}
+	entry := &blockCacheEntry{key: key, size: int64(len(data)), touched: time.Now()}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.currentSize += entry.size
+	c.mutex.Unlock()
+
+	c.evict()
+
+	return nil
+}
+
+func (c *BlockCache) touch(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	element.Value.(*blockCacheEntry).touched = time.Now()
+	c.lru.MoveToFront(element)
+}
+
+// evict removes the least-recently-used blocks until the cache is back
+// under its size budget
+func (c *BlockCache) evict() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.currentSize > c.chunkCacheSize {
+		oldest := c.lru.Back()
+		if nil == oldest {
+			return
+		}
+		entry := oldest.Value.(*blockCacheEntry)
+		if err := os.Remove(c.blockPath(entry.key)); nil != err && !os.IsNotExist(err) {
+			Log.Debugf("%v", err)
+		}
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.currentSize -= entry.size
+	}
+}
+
+// PurgeObject drops every cached block belonging to objectID
+func (c *BlockCache) PurgeObject(objectID string) error {
+	Log.Debugf("Purging chunk cache blocks for %v", objectID)
+
+	prefix := objectID + "/"
+
+	c.mutex.Lock()
+	var stale []*list.Element
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			stale = append(stale, element)
+		}
+	}
+	for _, element := range stale {
+		entry := element.Value.(*blockCacheEntry)
+		if err := os.Remove(c.blockPath(entry.key)); nil != err && !os.IsNotExist(err) {
+			Log.Debugf("%v", err)
+		}
+		c.lru.Remove(element)
+		delete(c.entries, entry.key)
+		c.currentSize -= entry.size
+	}
+	c.mutex.Unlock()
+
+	if err := os.Remove(filepath.Join(c.basePath, objectID)); nil != err && !os.IsNotExist(err) {
+		Log.Debugf("%v", err)
+	}
+
+	return nil
+}
+
+// Open returns a read-through stream for objectID starting at offset, serving
+// each chunkSize-aligned block from cache when present and otherwise pulling
+// it from openRange and caching it via PutBlock
+func (c *BlockCache) Open(objectID string, offset int64, openRange func(int64) (io.ReadCloser, error)) io.ReadCloser {
+	return &blockCacheReader{
+		cache:     c,
+		objectID:  objectID,
+		openRange: openRange,
+		blockIdx:  offset / c.chunkSize,
+		skip:      offset % c.chunkSize,
+	}
+}
+
+// blockCacheReader serves Read calls one chunkSize-aligned block at a time,
+// checking the BlockCache before falling through to openRange
+type blockCacheReader struct {
+	cache     *BlockCache
+	objectID  string
+	openRange func(int64) (io.ReadCloser, error)
+
+	blockIdx int64
+	skip     int64
+	block    io.Reader
+	source   io.ReadCloser
+}
+
+func (r *blockCacheReader) Read(p []byte) (int, error) {
+	for {
+		if nil != r.block {
+			n, err := r.block.Read(p)
+			if r.skip > 0 {
+				if int64(n) <= r.skip {
+					r.skip -= int64(n)
+					n = 0
+				} else {
+					copy(p, p[r.skip:n])
+					n -= int(r.skip)
+					r.skip = 0
+				}
+			}
+			if n > 0 {
+				return n, nil
+			}
+			if io.EOF == err {
+				r.block = nil
+				r.blockIdx++
+				continue
+			}
+			if nil != err {
+				return 0, err
+			}
+			continue
+		}
+
+		if data, ok := r.cache.GetBlock(r.objectID, r.blockIdx); ok {
+			// an empty cached block marks the end of the object
+			if 0 == len(data) {
+				return 0, io.EOF
+			}
+			r.block = bytes.NewReader(data)
+			continue
+		}
+
+		if nil == r.source {
+			source, err := r.openRange(r.blockIdx * r.cache.chunkSize)
+			if nil != err {
+				return 0, err
+			}
+			r.source = source
+		}
+
+		data := make([]byte, r.cache.chunkSize)
+		n, err := io.ReadFull(r.source, data)
+		if n > 0 {
+			if err := r.cache.PutBlock(r.objectID, r.blockIdx, data[:n]); nil != err {
+				Log.Debugf("%v", err)
+			}
+			r.block = bytes.NewReader(data[:n])
+			continue
+		}
+		if io.EOF == err || io.ErrUnexpectedEOF == err {
+			// cache an empty block as an end-of-object marker so a later
+			// read doesn't call openRange just to find the end again
+			if err := r.cache.PutBlock(r.objectID, r.blockIdx, nil); nil != err {
+				Log.Debugf("%v", err)
+			}
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+}
+
+func (r *blockCacheReader) Close() error {
+	if nil != r.source {
+		return r.source.Close()
+	}
+	return nil
+}
+
+// startGC periodically scans the chunk cache for blocks that are over quota
+func (c *BlockCache) startGC() {
+	for range time.Tick(blockCacheGCInterval) {
+		c.evict()
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestBlockCachePurgeObjectDoesNotCollide ensures an object id that is a
+// string-prefix of another (e.g. "file" vs "file_1") doesn't cause
+// PurgeObject to evict blocks belonging to the unrelated object.
+func TestBlockCachePurgeObjectDoesNotCollide(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-block-cache")
+	if nil != err {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaCache, err := NewBoltCache(dir)
+	if nil != err {
+		t.Fatalf("could not create meta cache: %v", err)
+	}
+	defer metaCache.Close()
+
+	cache, err := NewBlockCache(dir, DefaultChunkSize, DefaultChunkCacheSize, metaCache)
+	if nil != err {
+		t.Fatalf("could not create block cache: %v", err)
+	}
+
+	if err := cache.PutBlock("file", 1, []byte("a")); nil != err {
+		t.Fatalf("could not put block: %v", err)
+	}
+	if err := cache.PutBlock("file_1", 0, []byte("b")); nil != err {
+		t.Fatalf("could not put block: %v", err)
+	}
+
+	if err := cache.PurgeObject("file"); nil != err {
+		t.Fatalf("could not purge object: %v", err)
+	}
+
+	if _, ok := cache.GetBlock("file", 1); ok {
+		t.Fatalf("expected block for purged object to be gone")
+	}
+	if _, ok := cache.GetBlock("file_1", 0); !ok {
+		t.Fatalf("expected block for unrelated object to survive the purge")
+	}
+}
+
+// TestBlockCacheOpenCachesOnSecondRead exercises Open's read-through path: the
+// first read should fall through to openRange and populate the cache, and a
+// second read of the same object should be served from cache alone, never
+// calling openRange again.
+func TestBlockCacheOpenCachesOnSecondRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-block-cache")
+	if nil != err {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaCache, err := NewBoltCache(dir)
+	if nil != err {
+		t.Fatalf("could not create meta cache: %v", err)
+	}
+	defer metaCache.Close()
+
+	cache, err := NewBlockCache(dir, 4, DefaultChunkCacheSize, metaCache)
+	if nil != err {
+		t.Fatalf("could not create block cache: %v", err)
+	}
+
+	content := []byte("abcdefgh")
+	opens := 0
+	openRange := func(offset int64) (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(bytes.NewReader(content[offset:])), nil
+	}
+
+	first := cache.Open("file", 2, openRange)
+	got, err := ioutil.ReadAll(first)
+	if nil != err {
+		t.Fatalf("could not read through block cache: %v", err)
+	}
+	if "cdefgh" != string(got) {
+		t.Fatalf("expected %q, got %q", "cdefgh", got)
+	}
+	first.Close()
+	if 1 != opens {
+		t.Fatalf("expected exactly one openRange call on first read, got %v", opens)
+	}
+
+	second := cache.Open("file", 2, openRange)
+	got, err = ioutil.ReadAll(second)
+	if nil != err {
+		t.Fatalf("could not read through block cache: %v", err)
+	}
+	if "cdefgh" != string(got) {
+		t.Fatalf("expected %q, got %q", "cdefgh", got)
+	}
+	second.Close()
+	if 1 != opens {
+		t.Fatalf("expected second read to be served entirely from cache, got %v openRange calls", opens)
+	}
+}
+
+// TestBlockCachePurgeHookWiredToMetaCache ensures NewBlockCache registers
+// itself as the metadata cache's purge hook, so deleting an object through
+// the metadata cache also drops its cached blocks.
+func TestBlockCachePurgeHookWiredToMetaCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-block-cache")
+	if nil != err {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaCache, err := NewBoltCache(dir)
+	if nil != err {
+		t.Fatalf("could not create meta cache: %v", err)
+	}
+	defer metaCache.Close()
+
+	cache, err := NewBlockCache(dir, DefaultChunkSize, DefaultChunkCacheSize, metaCache)
+	if nil != err {
+		t.Fatalf("could not create block cache: %v", err)
+	}
+
+	if err := cache.PutBlock("file", 0, []byte("a")); nil != err {
+		t.Fatalf("could not put block: %v", err)
+	}
+	if err := metaCache.DeleteObject("file"); nil != err {
+		t.Fatalf("could not delete object: %v", err)
+	}
+
+	if _, ok := cache.GetBlock("file", 0); ok {
+		t.Fatalf("expected block to be purged when the metadata cache deleted its object")
+	}
+}
@@ -1,27 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	"time"
 
-	. "github.com/claudetech/loggo/default"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"golang.org/x/oauth2"
 )
 
-// Cache is the cache
-type Cache struct {
-	db        *gorm.DB
-	tx        *gorm.DB
-	backup    *gorm.DB
-	dbAction  chan cacheAction
-	tokenPath string
-}
+// CacheBackend constants select the cache implementation
+const (
+	// SqliteCacheBackend is the in-memory SQLite backend
+	SqliteCacheBackend = "sqlite"
+	// BoltCacheBackend is the embedded BoltDB backend
+	BoltCacheBackend = "bolt"
+	// RedisCacheBackend is the shared Redis backend
+	RedisCacheBackend = "redis"
+)
 
 const (
 	// StoreAction stores an object in cache
@@ -35,7 +33,7 @@ type cacheAction struct {
 	object *APIObject
 }
 
-// APIObject is a Google Drive file object
+// APIObject is a cloud storage file object
 type APIObject struct {
 	ObjectID     string `gorm:"primary_key"`
 	Name         string `gorm:"index"`
@@ -44,255 +42,180 @@ type APIObject struct {
 	LastModified time.Time
 	DownloadURL  string
 	Parents      string `gorm:"index"`
+	DriverType   string `gorm:"index"`
 }
 
-// PageToken is the last change id
+// PageToken is the last change id for a given driver
 type PageToken struct {
 	gorm.Model
-	Token string
+	Driver string `gorm:"index"`
+	Token  string
 }
 
-// NewCache creates a new cache instance
-func NewCache(cacheBasePath string, sqlDebug bool) (*Cache, error) {
-	Log.Debugf("Opening cache connection")
-	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not open cache database")
-	}
-	backupPath := filepath.Join(cacheBasePath, "cache")
-	backupDb, err := gorm.Open("sqlite3", backupPath)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not open cache backup database")
-	}
-
-	Log.Debugf("Migrating cache schema")
-	db.AutoMigrate(&APIObject{})
-	db.AutoMigrate(&PageToken{})
-	db.LogMode(sqlDebug)
-	backupDb.AutoMigrate(&APIObject{})
-	backupDb.AutoMigrate(&PageToken{})
-	backupDb.LogMode(sqlDebug)
-
-	cache := Cache{
-		db:        db,
-		backup:    backupDb,
-		dbAction:  make(chan cacheAction),
-		tokenPath: filepath.Join(cacheBasePath, "token.json"),
-	}
-
-	// Check if backup contains data and copy those data
-	var count int64
-	backupDb.Model(&APIObject{}).Count(&count)
-	if count > 0 {
-		copyDatabase(backupDb, db)
-		Log.Infof("Imported cached data from %v", backupPath)
-	}
-
-	go cache.startStoringQueue()
-
-	return &cache, nil
-}
+// Pending operation kinds for PendingOp.Op
+const (
+	// PendingCreate stages a new local file that needs to be uploaded
+	PendingCreate = iota
+	// PendingUpdate stages new contents for an existing object
+	PendingUpdate
+	// PendingRename stages a rename/move of an existing object
+	PendingRename
+	// PendingDelete stages the deletion of an existing object
+	PendingDelete
+)
 
-func (c *Cache) startStoringQueue() {
-	for {
-		action := <-c.dbAction
+// PendingOp is a queued write-back operation awaiting upload
+type PendingOp struct {
+	ID        string `gorm:"primary_key"`
+	LocalPath string
+	ObjectID  string `gorm:"index"`
+	ParentID  string `gorm:"index"`
+	Op        int
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	// NextAttemptAt is when this op becomes eligible for NextPending again
+	NextAttemptAt time.Time
+	// Failed marks an op that has exhausted uploaderMaxAttempts
+	Failed bool
+}
+
+// Cache is the interface implemented by all metadata cache backends
+type Cache interface {
+	// StartTransaction starts a new transaction
+	StartTransaction()
+	// EndTransaction ends the current transaction
+	EndTransaction()
+	// Backup persists the in memory state to disk
+	Backup()
+	// Close closes all handles held by the backend
+	Close() error
+
+	// LoadToken loads the OAuth2 token for the given driver from cache
+	LoadToken(driver string) (*oauth2.Token, error)
+	// StoreToken stores the OAuth2 token for the given driver in the cache
+	StoreToken(driver string, token *oauth2.Token) error
+
+	// GetObject gets an object by id
+	GetObject(id string) (*APIObject, error)
+	// GetObjectsByParent get all objects under parent id
+	GetObjectsByParent(parent string) ([]*APIObject, error)
+	// GetObjectByParentAndName finds a child element by name and its parent id
+	GetObjectByParentAndName(parent, name string) (*APIObject, error)
+	// DeleteObject deletes an object by id
+	DeleteObject(id string) error
+	// UpdateObject updates an object
+	UpdateObject(object *APIObject) error
+
+	// StoreStartPageToken stores driver's page token for changes
+	StoreStartPageToken(driver, token string) error
+	// GetStartPageToken gets driver's start page token
+	GetStartPageToken(driver string) (string, error)
+
+	// SetPurgeHook registers a function to be called with an object's id
+	// whenever DeleteObject or UpdateObject changes it
+	SetPurgeHook(hook func(objectID string))
+
+	// EnqueuePending stages a write-back operation for the uploader to pick up
+	EnqueuePending(op *PendingOp) error
+	// NextPending returns the oldest pending operation eligible to run now
+	NextPending() (*PendingOp, error)
+	// CompletePending removes a pending operation once it has been applied
+	CompletePending(id string) error
+	// FailPending records a failed upload attempt against a pending operation
+	FailPending(id string, cause error) error
+}
+
+// overlayPendingOnChildren folds a parent's pending operations into its
+// already-fetched children
+func overlayPendingOnChildren(objects []*APIObject, parentID string, pending []*PendingOp) []*APIObject {
+	for _, op := range pending {
+		if op.ParentID != parentID {
+			continue
+		}
 
-		if nil != action.object {
-			if action.action == DeleteAction || action.action == StoreAction {
-				Log.Debugf("Deleting object %v", action.object.ObjectID)
-				c.tx.Unscoped().Delete(action.object)
+		switch op.Op {
+		case PendingCreate:
+			objects = append(objects, &APIObject{
+				ObjectID: "pending:" + op.ID,
+				Name:     filepath.Base(op.LocalPath),
+				Parents:  "|" + parentID + "|",
+			})
+		case PendingRename:
+			for _, object := range objects {
+				if object.ObjectID == op.ObjectID {
+					object.Name = filepath.Base(op.LocalPath)
+				}
 			}
-			if action.action == StoreAction {
-				Log.Debugf("Storing object %v in cache", action.object.ObjectID)
-				c.tx.Unscoped().Create(action.object)
+		case PendingDelete:
+			kept := objects[:0]
+			for _, object := range objects {
+				if object.ObjectID != op.ObjectID {
+					kept = append(kept, object)
+				}
 			}
+			objects = kept
 		}
 	}
-}
-
-// StartTransaction starts a new transaction
-func (c *Cache) StartTransaction() {
-	c.tx = c.db.Begin()
-}
-
-// EndTransaction ends the current transaction
-func (c *Cache) EndTransaction() {
-	c.tx.Commit()
-}
-
-// Backup backups the in memory cache to disk
-func (c *Cache) Backup() {
-	Log.Debugf("Backup cache database")
-	copyDatabase(c.db, c.backup)
-}
-
-// Close closes all handles
-func (c *Cache) Close() error {
-	Log.Debugf("Closing cache connection")
-
-	close(c.dbAction)
-	if err := c.db.Close(); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not close cache connection")
-	}
-	if err := c.backup.Close(); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not close cache backup connection")
-	}
-
-	return nil
-}
-
-// LoadToken loads a token from cache
-func (c *Cache) LoadToken() (*oauth2.Token, error) {
-	Log.Debugf("Loading token from cache")
-
-	tokenFile, err := ioutil.ReadFile(c.tokenPath)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not read token file in %v", c.tokenPath)
-	}
-
-	var token oauth2.Token
-	json.Unmarshal(tokenFile, &token)
-
-	Log.Tracef("Got token from cache %v", token)
-
-	return &token, nil
-}
-
-// StoreToken stores a token in the cache or updates the existing token element
-func (c *Cache) StoreToken(token *oauth2.Token) error {
-	Log.Debugf("Storing token to cache")
-
-	tokenJSON, err := json.Marshal(token)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json content")
-	}
 
-	if err := ioutil.WriteFile(c.tokenPath, tokenJSON, 0644); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json file")
-	}
-
-	return nil
-}
-
-// GetObject gets an object by id
-func (c *Cache) GetObject(id string) (*APIObject, error) {
-	Log.Tracef("Getting object %v", id)
-
-	var object APIObject
-	c.db.Where(&APIObject{ObjectID: id}).First(&object)
-
-	Log.Tracef("Got object from cache %v", object)
-
-	if "" != object.ObjectID {
-		return &object, nil
-	}
-
-	return nil, fmt.Errorf("Could not find object %v in cache", id)
-}
-
-// GetObjectsByParent get all objects under parent id
-func (c *Cache) GetObjectsByParent(parent string) ([]*APIObject, error) {
-	Log.Tracef("Getting children for %v", parent)
-
-	var objects []*APIObject
-	c.db.Where("parents LIKE ?", fmt.Sprintf("%%|%v|%%", parent)).Find(&objects)
-
-	Log.Tracef("Got objects from cache %v", objects)
-
-	if 0 != len(objects) {
-		return objects, nil
-	}
-
-	return nil, fmt.Errorf("Could not find children for parent %v in cache", parent)
+	return objects
 }
 
-// GetObjectByParentAndName finds a child element by name and its parent id
-func (c *Cache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
-	Log.Tracef("Getting object %v in parent %v", name, parent)
-
-	var object APIObject
-	c.db.Where("parents LIKE ? AND name = ?", fmt.Sprintf("%%|%v|%%", parent), name).First(&object)
-
-	Log.Tracef("Got object from cache %v", object)
-
-	if "" != object.ObjectID {
-		return &object, nil
+// overlayPendingOnObject applies any pending rename/delete targeting object,
+// returning nil if object is staged for deletion
+func overlayPendingOnObject(object *APIObject, pending []*PendingOp) *APIObject {
+	for _, op := range pending {
+		if op.ObjectID != object.ObjectID {
+			continue
+		}
+		switch op.Op {
+		case PendingRename:
+			object.Name = filepath.Base(op.LocalPath)
+		case PendingDelete:
+			return nil
+		}
 	}
 
-	return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+	return object
 }
 
-// DeleteObject deletes an object by id
-func (c *Cache) DeleteObject(id string) error {
-	c.dbAction <- cacheAction{
-		action: DeleteAction,
-		object: &APIObject{ObjectID: id},
-	}
-	return nil
-}
-
-// UpdateObject updates an object
-func (c *Cache) UpdateObject(object *APIObject) error {
-	c.dbAction <- cacheAction{
-		action: StoreAction,
-		object: object,
+// pickNextPending selects the oldest-created pending operation that isn't
+// Failed and isn't still inside its backoff window, or nil if none are eligible
+func pickNextPending(pending []*PendingOp, now time.Time) *PendingOp {
+	var oldest *PendingOp
+	for _, op := range pending {
+		if op.Failed || op.NextAttemptAt.After(now) {
+			continue
+		}
+		if nil == oldest || op.CreatedAt.Before(oldest.CreatedAt) {
+			oldest = op
+		}
 	}
-	return nil
-}
-
-// StoreStartPageToken stores the page token for changes
-func (c *Cache) StoreStartPageToken(token string) error {
-	Log.Debugf("Storing page token %v in cache", token)
-
-	c.tx.Unscoped().Delete(&PageToken{})
-	c.tx.Unscoped().Create(&PageToken{
-		Token: token,
-	})
-
-	return nil
+	return oldest
 }
 
-// GetStartPageToken gets the start page token
-func (c *Cache) GetStartPageToken() (string, error) {
-	Log.Debugf("Getting start page token from cache")
-
-	var pageToken PageToken
-	c.db.First(&pageToken)
-
-	Log.Tracef("Got start page token %v", pageToken.Token)
-
-	if "" == pageToken.Token {
-		return "", fmt.Errorf("Token not found in cache")
+// parentIDs splits an APIObject's Parents field ("|parentID1|parentID2|")
+// into the individual parent ids it references
+func parentIDs(parents string) []string {
+	var ids []string
+	for _, id := range strings.Split(strings.Trim(parents, "|"), "|") {
+		if "" != id {
+			ids = append(ids, id)
+		}
 	}
-
-	return pageToken.Token, nil
+	return ids
 }
 
-func copyDatabase(src *gorm.DB, dest *gorm.DB) {
-	tx := dest.Begin()
-
-	// delete old data
-	tx.Unscoped().Delete(&PageToken{})
-	tx.Unscoped().Delete(&APIObject{})
-
-	// copy page token
-	var token PageToken
-	src.First(&token)
-	tx.Unscoped().Create(&token)
-
-	// copy objects
-	var objects []*APIObject
-	src.Find(&objects)
-	for _, object := range objects {
-		tx.Unscoped().Create(object)
+// NewCache creates a new cache instance for the given backend
+func NewCache(backend, cacheBasePath string, sqlDebug bool) (Cache, error) {
+	switch backend {
+	case "", SqliteCacheBackend:
+		return NewSqliteCache(cacheBasePath, sqlDebug)
+	case BoltCacheBackend:
+		return NewBoltCache(cacheBasePath)
+	case RedisCacheBackend:
+		return NewRedisCache(cacheBasePath)
+	default:
+		return nil, fmt.Errorf("Unknown cache backend %v", backend)
 	}
-
-	tx.Commit()
 }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	. "github.com/claudetech/loggo/default"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+var (
+	boltObjectsBucket = []byte("objects")
+	boltParentsBucket = []byte("parents")
+	boltNamesBucket   = []byte("names")
+	boltMetaBucket    = []byte("meta")
+	boltPendingBucket = []byte("pending")
+
+	boltPageTokenKeyPrefix = "page_token:"
+)
+
+// BoltCache is an embedded key/value cache backend backed by BoltDB
+type BoltCache struct {
+	db        *bolt.DB
+	tx        *bolt.Tx
+	purgeHook func(objectID string)
+}
+
+// SetPurgeHook registers a function to be called with an object's id
+// whenever DeleteObject or UpdateObject changes it
+func (c *BoltCache) SetPurgeHook(hook func(objectID string)) {
+	c.purgeHook = hook
+}
+
+// NewBoltCache creates a new BoltDB backed cache instance
+func NewBoltCache(cacheBasePath string) (*BoltCache, error) {
+	Log.Debugf("Opening bolt cache connection")
+
+	dbPath := filepath.Join(cacheBasePath, "cache.bolt")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache database")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltObjectsBucket, boltParentsBucket, boltNamesBucket, boltMetaBucket, boltPendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not migrate cache database")
+	}
+
+	return &BoltCache{db: db}, nil
+}
+
+// StartTransaction starts a new write transaction
+func (c *BoltCache) StartTransaction() {
+	tx, err := c.db.Begin(true)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	c.tx = tx
+}
+
+// EndTransaction commits the current transaction
+func (c *BoltCache) EndTransaction() {
+	if nil == c.tx {
+		return
+	}
+	if err := c.tx.Commit(); nil != err {
+		Log.Debugf("%v", err)
+	}
+	c.tx = nil
+}
+
+// Backup is a no-op for BoltCache: every write already goes straight to disk
+func (c *BoltCache) Backup() {
+}
+
+// Close closes the database handle
+func (c *BoltCache) Close() error {
+	Log.Debugf("Closing bolt cache connection")
+	if err := c.db.Close(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not close cache connection")
+	}
+	return nil
+}
+
+func boltTokenKey(driver string) []byte {
+	return []byte("oauth_token:" + driver)
+}
+
+// LoadToken loads the given driver's OAuth2 token from cache
+func (c *BoltCache) LoadToken(driver string) (*oauth2.Token, error) {
+	Log.Debugf("Loading token for %v from cache", driver)
+
+	var token oauth2.Token
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltMetaBucket).Get(boltTokenKey(driver))
+		if nil == data {
+			return fmt.Errorf("Could not find token for driver %v in cache", driver)
+		}
+		return json.Unmarshal(data, &token)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	Log.Tracef("Got token from cache %v", token)
+	return &token, nil
+}
+
+// StoreToken stores the given driver's OAuth2 token in the cache
+func (c *BoltCache) StoreToken(driver string, token *oauth2.Token) error {
+	Log.Debugf("Storing token for %v to cache", driver)
+
+	tokenJSON, err := json.Marshal(token)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json content")
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltTokenKey(driver), tokenJSON)
+	})
+}
+
+// withWriteTx runs fn against the active transaction, or a one-off write
+// transaction if none is active
+func (c *BoltCache) withWriteTx(fn func(tx *bolt.Tx) error) error {
+	if nil != c.tx {
+		return fn(c.tx)
+	}
+	return c.db.Update(fn)
+}
+
+// GetObject gets an object by id, overlaid with any pending rename/delete
+// staged against it
+func (c *BoltCache) GetObject(id string) (*APIObject, error) {
+	Log.Tracef("Getting object %v", id)
+
+	object, err := c.getObject(id)
+	if nil != err {
+		return nil, err
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	object = overlayPendingOnObject(object, pending)
+	if nil == object {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+
+	Log.Tracef("Got object from cache %v", object)
+	return object, nil
+}
+
+func (c *BoltCache) getObject(id string) (*APIObject, error) {
+	var object APIObject
+	found := false
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltObjectsBucket).Get([]byte(id))
+		if nil == data {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &object)
+	})
+	if nil != err {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+	return &object, nil
+}
+
+// GetObjectsByParent get all objects under parent id via the parent index,
+// overlaid with any pending creates/renames/deletes staged under that parent
+func (c *BoltCache) GetObjectsByParent(parent string) ([]*APIObject, error) {
+	Log.Tracef("Getting children for %v", parent)
+
+	var objects []*APIObject
+	err := c.db.View(func(tx *bolt.Tx) error {
+		objectsBucket := tx.Bucket(boltObjectsBucket)
+		cursor := tx.Bucket(boltParentsBucket).Cursor()
+		prefix := []byte(parent + "|")
+		for key, value := cursor.Seek(prefix); nil != key && strings.HasPrefix(string(key), string(prefix)); key, value = cursor.Next() {
+			data := objectsBucket.Get(value)
+			if nil == data {
+				continue
+			}
+			var object APIObject
+			if err := json.Unmarshal(data, &object); nil != err {
+				return err
+			}
+			objects = append(objects, &object)
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	Log.Tracef("Got objects from cache %v", objects)
+	if 0 != len(objects) {
+		return objects, nil
+	}
+	return nil, fmt.Errorf("Could not find children for parent %v in cache", parent)
+}
+
+// GetObjectByParentAndName finds a child element by name and its parent id via the name index
+func (c *BoltCache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
+	Log.Tracef("Getting object %v in parent %v", name, parent)
+
+	var object *APIObject
+	err := c.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltNamesBucket).Get([]byte(parent + "|" + name))
+		if nil == id {
+			return nil
+		}
+		data := tx.Bucket(boltObjectsBucket).Get(id)
+		if nil == data {
+			return nil
+		}
+		var found APIObject
+		if err := json.Unmarshal(data, &found); nil != err {
+			return err
+		}
+		object = &found
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	var objects []*APIObject
+	if nil != object {
+		objects = []*APIObject{object}
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	for _, candidate := range objects {
+		if candidate.Name == name {
+			Log.Tracef("Got object from cache %v", candidate)
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+}
+
+// DeleteObject deletes an object by id, removing it from the object store
+// and both secondary indexes
+func (c *BoltCache) DeleteObject(id string) error {
+	Log.Debugf("Deleting object %v", id)
+
+	existing, err := c.getObject(id)
+	if nil != err {
+		existing = nil
+	}
+
+	err = c.withWriteTx(func(tx *bolt.Tx) error {
+		if nil != existing {
+			if err := removeIndexes(tx, existing); nil != err {
+				return err
+			}
+		}
+		return tx.Bucket(boltObjectsBucket).Delete([]byte(id))
+	})
+	if nil != err {
+		return err
+	}
+
+	if nil != c.purgeHook {
+		c.purgeHook(id)
+	}
+	return nil
+}
+
+// removeIndexes drops object's entries from both secondary indexes
+func removeIndexes(tx *bolt.Tx, object *APIObject) error {
+	parentsBucket := tx.Bucket(boltParentsBucket)
+	namesBucket := tx.Bucket(boltNamesBucket)
+	for _, parentID := range parentIDs(object.Parents) {
+		if err := parentsBucket.Delete([]byte(parentID + "|" + object.ObjectID)); nil != err {
+			return err
+		}
+		if err := namesBucket.Delete([]byte(parentID + "|" + object.Name)); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateObject updates or creates an object, refreshing its secondary
+// indexes in the process
+func (c *BoltCache) UpdateObject(object *APIObject) error {
+	Log.Debugf("Storing object %v in cache", object.ObjectID)
+
+	existing, _ := c.getObject(object.ObjectID)
+
+	data, err := json.Marshal(object)
+	if nil != err {
+		return err
+	}
+
+	err = c.withWriteTx(func(tx *bolt.Tx) error {
+		if nil != existing {
+			if err := removeIndexes(tx, existing); nil != err {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltObjectsBucket).Put([]byte(object.ObjectID), data); nil != err {
+			return err
+		}
+		parentsBucket := tx.Bucket(boltParentsBucket)
+		namesBucket := tx.Bucket(boltNamesBucket)
+		for _, parentID := range parentIDs(object.Parents) {
+			if err := parentsBucket.Put([]byte(parentID+"|"+object.ObjectID), []byte(object.ObjectID)); nil != err {
+				return err
+			}
+			if err := namesBucket.Put([]byte(parentID+"|"+object.Name), []byte(object.ObjectID)); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return err
+	}
+
+	if nil != c.purgeHook {
+		c.purgeHook(object.ObjectID)
+	}
+	return nil
+}
+
+// StoreStartPageToken stores driver's page token for changes
+func (c *BoltCache) StoreStartPageToken(driver, token string) error {
+	Log.Debugf("Storing page token %v for %v in cache", token, driver)
+
+	return c.withWriteTx(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put([]byte(boltPageTokenKeyPrefix+driver), []byte(token))
+	})
+}
+
+// GetStartPageToken gets driver's start page token
+func (c *BoltCache) GetStartPageToken(driver string) (string, error) {
+	Log.Debugf("Getting start page token for %v from cache", driver)
+
+	var token string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltMetaBucket).Get([]byte(boltPageTokenKeyPrefix + driver))
+		if nil == data {
+			return fmt.Errorf("Token not found in cache for %v", driver)
+		}
+		token = string(data)
+		return nil
+	})
+	if nil != err {
+		return "", err
+	}
+
+	Log.Tracef("Got start page token %v", token)
+	return token, nil
+}
+
+// allPending returns every staged pending operation
+func (c *BoltCache) allPending() ([]*PendingOp, error) {
+	var pending []*PendingOp
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPendingBucket).ForEach(func(key, data []byte) error {
+			var op PendingOp
+			if err := json.Unmarshal(data, &op); nil != err {
+				return err
+			}
+			pending = append(pending, &op)
+			return nil
+		})
+	})
+	return pending, err
+}
+
+// EnqueuePending stages a write-back operation for the uploader to pick up
+func (c *BoltCache) EnqueuePending(op *PendingOp) error {
+	if "" == op.ID {
+		op.ID = uuid.New().String()
+	}
+	if op.CreatedAt.IsZero() {
+		op.CreatedAt = time.Now()
+	}
+
+	Log.Debugf("Enqueuing pending %v for %v", op.Op, op.ObjectID)
+
+	data, err := json.Marshal(op)
+	if nil != err {
+		return err
+	}
+	return c.withWriteTx(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPendingBucket).Put([]byte(op.ID), data)
+	})
+}
+
+// NextPending returns the oldest pending operation that is still awaiting
+// upload and not currently backing off from a previous failure
+func (c *BoltCache) NextPending() (*PendingOp, error) {
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+
+	oldest := pickNextPending(pending, time.Now())
+	if nil == oldest {
+		return nil, fmt.Errorf("No pending operations in cache")
+	}
+	return oldest, nil
+}
+
+// CompletePending removes a pending operation once it has been applied to
+// the storage backend
+func (c *BoltCache) CompletePending(id string) error {
+	Log.Debugf("Completing pending operation %v", id)
+	return c.withWriteTx(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPendingBucket).Delete([]byte(id))
+	})
+}
+
+// FailPending records a failed upload attempt against a pending operation
+func (c *BoltCache) FailPending(id string, cause error) error {
+	Log.Debugf("Pending operation %v failed: %v", id, cause)
+
+	return c.withWriteTx(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltPendingBucket)
+		data := bucket.Get([]byte(id))
+		if nil == data {
+			return fmt.Errorf("Could not find pending operation %v in cache", id)
+		}
+
+		var op PendingOp
+		if err := json.Unmarshal(data, &op); nil != err {
+			return err
+		}
+		op.Attempts++
+		op.LastError = cause.Error()
+		op.NextAttemptAt = time.Now().Add(backoffDuration(op.Attempts))
+		if op.Attempts >= uploaderMaxAttempts {
+			op.Failed = true
+		}
+
+		updated, err := json.Marshal(op)
+		if nil != err {
+			return err
+		}
+		return bucket.Put([]byte(id), updated)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestBoltCache(t *testing.T) *BoltCache {
+	dir, err := ioutil.TempDir("", "plexdrive-bolt-cache")
+	if nil != err {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cache, err := NewBoltCache(dir)
+	if nil != err {
+		t.Fatalf("could not create bolt cache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+// TestBoltCacheGetObjectsByParent covers the parent secondary index, which
+// previously never matched because it was written with the wrapped
+// "|parentID|" form but queried with the bare parent id.
+func TestBoltCacheGetObjectsByParent(t *testing.T) {
+	cache := newTestBoltCache(t)
+
+	if err := cache.UpdateObject(&APIObject{
+		ObjectID: "child1",
+		Name:     "a.txt",
+		Parents:  "|root|",
+	}); nil != err {
+		t.Fatalf("could not store object: %v", err)
+	}
+	if err := cache.UpdateObject(&APIObject{
+		ObjectID: "child2",
+		Name:     "b.txt",
+		Parents:  "|other|",
+	}); nil != err {
+		t.Fatalf("could not store object: %v", err)
+	}
+
+	objects, err := cache.GetObjectsByParent("root")
+	if nil != err {
+		t.Fatalf("GetObjectsByParent returned an error: %v", err)
+	}
+	if 1 != len(objects) || "child1" != objects[0].ObjectID {
+		t.Fatalf("expected only child1 under root, got %v", objects)
+	}
+
+	object, err := cache.GetObjectByParentAndName("root", "a.txt")
+	if nil != err {
+		t.Fatalf("GetObjectByParentAndName returned an error: %v", err)
+	}
+	if "child1" != object.ObjectID {
+		t.Fatalf("expected child1, got %v", object.ObjectID)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// journalRecord is the on-disk representation of a single cacheAction,
+// written as a 4 byte big-endian length prefix followed by JSON
+type journalRecord struct {
+	Action int        `json:"action"`
+	Object *APIObject `json:"object"`
+}
+
+// cacheJournal is an append-only write-ahead log of cacheActions, compacted
+// into the on-disk snapshot by Backup
+type cacheJournal struct {
+	path string
+	file *os.File
+	// mu guards file, since Append and Compact run from different goroutines
+	mu sync.Mutex
+}
+
+func openCacheJournal(path string) (*cacheJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if nil != err {
+		return nil, fmt.Errorf("Could not open cache journal %v", path)
+	}
+	return &cacheJournal{path: path, file: file}, nil
+}
+
+// Append writes a single record to the journal and fsyncs it
+func (j *cacheJournal) Append(action cacheAction) error {
+	data, err := json.Marshal(journalRecord{Action: action.action, Object: action.object})
+	if nil != err {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(length[:]); nil != err {
+		return err
+	}
+	if _, err := j.file.Write(data); nil != err {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Replay reads every well-formed record in the journal and invokes apply for
+// each one, in order; a truncated final record is silently dropped
+func (j *cacheJournal) Replay(apply func(cacheAction)) error {
+	file, err := os.Open(j.path)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); nil != err {
+			return nil
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(reader, data); nil != err {
+			Log.Debugf("Discarding truncated journal record: %v", err)
+			return nil
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(data, &record); nil != err {
+			Log.Debugf("Discarding corrupt journal record: %v", err)
+			continue
+		}
+
+		apply(cacheAction{action: record.Action, object: record.Object})
+	}
+}
+
+// Compact truncates the journal now that its contents have been folded into
+// a fresh snapshot by the caller
+func (j *cacheJournal) Compact() error {
+	tmpPath := j.path + ".compact"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if nil != err {
+		return fmt.Errorf("Could not create compacted cache journal %v", tmpPath)
+	}
+	if err := tmpFile.Close(); nil != err {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Close(); nil != err {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); nil != err {
+		return fmt.Errorf("Could not replace cache journal %v", j.path)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if nil != err {
+		return fmt.Errorf("Could not reopen cache journal %v", j.path)
+	}
+	j.file = file
+	return nil
+}
+
+// Close closes the underlying journal file
+func (j *cacheJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// Size returns the current size of the on-disk journal file
+func (j *cacheJournal) Size() (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info, err := j.file.Stat()
+	if nil != err {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+const (
+	redisObjectKeyPrefix    = "plexdrive:object:"
+	redisParentKeyPrefix    = "plexdrive:parent:"
+	redisNameKeyPrefix      = "plexdrive:name:"
+	redisPageTokenKeyPrefix = "plexdrive:page_token:"
+	redisTokenKeyPrefix     = "plexdrive:oauth_token:"
+	redisPendingSetKey      = "plexdrive:pending"
+	redisPendingKeyPrefix   = "plexdrive:pending:"
+)
+
+// RedisCache is a cache backend that stores objects in a shared Redis instance
+type RedisCache struct {
+	client    *redis.Client
+	purgeHook func(objectID string)
+}
+
+// SetPurgeHook registers a function to be called with an object's id
+// whenever DeleteObject or UpdateObject changes it
+func (c *RedisCache) SetPurgeHook(hook func(objectID string)) {
+	c.purgeHook = hook
+}
+
+// NewRedisCache creates a new Redis backed cache instance.
+func NewRedisCache(cacheBasePath string) (*RedisCache, error) {
+	Log.Debugf("Opening redis cache connection")
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+	if err := client.Ping().Err(); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not connect to redis cache")
+	}
+
+	return &RedisCache{client: client}, nil
+}
+
+// StartTransaction is a no-op for RedisCache
+func (c *RedisCache) StartTransaction() {
+}
+
+// EndTransaction is a no-op for RedisCache
+func (c *RedisCache) EndTransaction() {
+}
+
+// Backup is a no-op for RedisCache: persistence is configured on the server
+func (c *RedisCache) Backup() {
+}
+
+// Close closes the redis client
+func (c *RedisCache) Close() error {
+	Log.Debugf("Closing redis cache connection")
+	if err := c.client.Close(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not close cache connection")
+	}
+	return nil
+}
+
+// LoadToken loads the given driver's OAuth2 token from cache
+func (c *RedisCache) LoadToken(driver string) (*oauth2.Token, error) {
+	Log.Debugf("Loading token for %v from cache", driver)
+
+	data, err := c.client.Get(redisTokenKeyPrefix + driver).Bytes()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not find token for driver %v in cache", driver)
+	}
+
+	var token oauth2.Token
+	json.Unmarshal(data, &token)
+
+	Log.Tracef("Got token from cache %v", token)
+	return &token, nil
+}
+
+// StoreToken stores the given driver's OAuth2 token in the cache
+func (c *RedisCache) StoreToken(driver string, token *oauth2.Token) error {
+	Log.Debugf("Storing token for %v to cache", driver)
+
+	tokenJSON, err := json.Marshal(token)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json content")
+	}
+
+	if err := c.client.Set(redisTokenKeyPrefix+driver, tokenJSON, 0).Err(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store token for driver %v", driver)
+	}
+	return nil
+}
+
+// GetObject gets an object by id, overlaid with any pending rename/delete
+// staged against it
+func (c *RedisCache) GetObject(id string) (*APIObject, error) {
+	Log.Tracef("Getting object %v", id)
+
+	object, err := c.getObject(id)
+	if nil != err {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	object = overlayPendingOnObject(object, pending)
+	if nil == object {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+
+	Log.Tracef("Got object from cache %v", object)
+	return object, nil
+}
+
+func (c *RedisCache) getObject(id string) (*APIObject, error) {
+	data, err := c.client.Get(redisObjectKeyPrefix + id).Bytes()
+	if nil != err {
+		return nil, err
+	}
+	var object APIObject
+	if err := json.Unmarshal(data, &object); nil != err {
+		return nil, err
+	}
+	return &object, nil
+}
+
+// GetObjectsByParent get all objects under parent id via the parent index set
+func (c *RedisCache) GetObjectsByParent(parent string) ([]*APIObject, error) {
+	Log.Tracef("Getting children for %v", parent)
+
+	ids, err := c.client.SMembers(redisParentKeyPrefix + parent).Result()
+	if nil != err {
+		return nil, fmt.Errorf("Could not find children for parent %v in cache", parent)
+	}
+
+	var objects []*APIObject
+	for _, id := range ids {
+		object, err := c.getObject(id)
+		if nil != err {
+			continue
+		}
+		objects = append(objects, object)
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	Log.Tracef("Got objects from cache %v", objects)
+	if 0 == len(objects) {
+		return nil, fmt.Errorf("Could not find children for parent %v in cache", parent)
+	}
+	return objects, nil
+}
+
+// GetObjectByParentAndName finds a child element by name and its parent id via the name index
+func (c *RedisCache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
+	Log.Tracef("Getting object %v in parent %v", name, parent)
+
+	var objects []*APIObject
+	if id, err := c.client.Get(redisNameKeyPrefix + parent + "|" + name).Result(); nil == err {
+		if object, err := c.getObject(id); nil == err {
+			objects = append(objects, object)
+		}
+	}
+
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	for _, object := range objects {
+		if object.Name == name {
+			Log.Tracef("Got object from cache %v", object)
+			return object, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+}
+
+// DeleteObject deletes an object by id, removing it from both secondary
+// index sets as well
+func (c *RedisCache) DeleteObject(id string) error {
+	Log.Debugf("Deleting object %v", id)
+
+	existing, err := c.getObject(id)
+	pipe := c.client.Pipeline()
+	pipe.Del(redisObjectKeyPrefix + id)
+	if nil == err {
+		for _, parentID := range parentIDs(existing.Parents) {
+			pipe.SRem(redisParentKeyPrefix+parentID, id)
+			pipe.Del(redisNameKeyPrefix + parentID + "|" + existing.Name)
+		}
+	}
+	if _, err := pipe.Exec(); nil != err {
+		return err
+	}
+
+	if nil != c.purgeHook {
+		c.purgeHook(id)
+	}
+	return nil
+}
+
+// UpdateObject updates or creates an object, refreshing its secondary
+// indexes in the process
+func (c *RedisCache) UpdateObject(object *APIObject) error {
+	Log.Debugf("Storing object %v in cache", object.ObjectID)
+
+	existing, existingErr := c.getObject(object.ObjectID)
+
+	data, err := json.Marshal(object)
+	if nil != err {
+		return err
+	}
+
+	pipe := c.client.Pipeline()
+	if nil == existingErr {
+		for _, parentID := range parentIDs(existing.Parents) {
+			pipe.SRem(redisParentKeyPrefix+parentID, object.ObjectID)
+			pipe.Del(redisNameKeyPrefix + parentID + "|" + existing.Name)
+		}
+	}
+	pipe.Set(redisObjectKeyPrefix+object.ObjectID, data, 0)
+	for _, parentID := range parentIDs(object.Parents) {
+		pipe.SAdd(redisParentKeyPrefix+parentID, object.ObjectID)
+		pipe.Set(redisNameKeyPrefix+parentID+"|"+object.Name, object.ObjectID, 0)
+	}
+
+	if _, err := pipe.Exec(); nil != err {
+		return err
+	}
+
+	if nil != c.purgeHook {
+		c.purgeHook(object.ObjectID)
+	}
+	return nil
+}
+
+// StoreStartPageToken stores driver's page token for changes
+func (c *RedisCache) StoreStartPageToken(driver, token string) error {
+	Log.Debugf("Storing page token %v for %v in cache", token, driver)
+	return c.client.Set(redisPageTokenKeyPrefix+driver, token, 0).Err()
+}
+
+// GetStartPageToken gets driver's start page token
+func (c *RedisCache) GetStartPageToken(driver string) (string, error) {
+	Log.Debugf("Getting start page token for %v from cache", driver)
+
+	token, err := c.client.Get(redisPageTokenKeyPrefix + driver).Result()
+	if nil != err || "" == token {
+		return "", fmt.Errorf("Token not found in cache for %v", driver)
+	}
+
+	Log.Tracef("Got start page token %v", token)
+	return token, nil
+}
+
+// allPending returns every staged pending operation
+func (c *RedisCache) allPending() ([]*PendingOp, error) {
+	ids, err := c.client.SMembers(redisPendingSetKey).Result()
+	if nil != err {
+		return nil, err
+	}
+
+	var pending []*PendingOp
+	for _, id := range ids {
+		data, err := c.client.Get(redisPendingKeyPrefix + id).Bytes()
+		if nil != err {
+			continue
+		}
+		var op PendingOp
+		if err := json.Unmarshal(data, &op); nil != err {
+			continue
+		}
+		pending = append(pending, &op)
+	}
+	return pending, nil
+}
+
+// EnqueuePending stages a write-back operation for the uploader to pick up
+func (c *RedisCache) EnqueuePending(op *PendingOp) error {
+	if "" == op.ID {
+		op.ID = uuid.New().String()
+	}
+	if op.CreatedAt.IsZero() {
+		op.CreatedAt = time.Now()
+	}
+
+	Log.Debugf("Enqueuing pending %v for %v", op.Op, op.ObjectID)
+
+	data, err := json.Marshal(op)
+	if nil != err {
+		return err
+	}
+
+	pipe := c.client.Pipeline()
+	pipe.Set(redisPendingKeyPrefix+op.ID, data, 0)
+	pipe.SAdd(redisPendingSetKey, op.ID)
+	_, err = pipe.Exec()
+	return err
+}
+
+// NextPending returns the oldest pending operation that is still awaiting
+// upload and not currently backing off from a previous failure
+func (c *RedisCache) NextPending() (*PendingOp, error) {
+	pending, err := c.allPending()
+	if nil != err {
+		return nil, err
+	}
+
+	oldest := pickNextPending(pending, time.Now())
+	if nil == oldest {
+		return nil, fmt.Errorf("No pending operations in cache")
+	}
+	return oldest, nil
+}
+
+// CompletePending removes a pending operation once it has been applied to
+// the storage backend
+func (c *RedisCache) CompletePending(id string) error {
+	Log.Debugf("Completing pending operation %v", id)
+
+	pipe := c.client.Pipeline()
+	pipe.Del(redisPendingKeyPrefix + id)
+	pipe.SRem(redisPendingSetKey, id)
+	_, err := pipe.Exec()
+	return err
+}
+
+// FailPending records a failed upload attempt against a pending operation
+func (c *RedisCache) FailPending(id string, cause error) error {
+	Log.Debugf("Pending operation %v failed: %v", id, cause)
+
+	data, err := c.client.Get(redisPendingKeyPrefix + id).Bytes()
+	if nil != err {
+		return fmt.Errorf("Could not find pending operation %v in cache", id)
+	}
+
+	var op PendingOp
+	if err := json.Unmarshal(data, &op); nil != err {
+		return err
+	}
+	op.Attempts++
+	op.LastError = cause.Error()
+	op.NextAttemptAt = time.Now().Add(backoffDuration(op.Attempts))
+	if op.Attempts >= uploaderMaxAttempts {
+		op.Failed = true
+	}
+
+	updated, err := json.Marshal(op)
+	if nil != err {
+		return err
+	}
+	return c.client.Set(redisPendingKeyPrefix+id, updated, 0).Err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newTestRedisCache connects to a local redis instance, skipping the test if
+// one isn't reachable (redis is an external dependency, not something CI
+// spins up for every run).
+func newTestRedisCache(t *testing.T) *RedisCache {
+	cache, err := NewRedisCache("")
+	if nil != err {
+		t.Skipf("redis not available: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+// TestRedisCacheGetObjectsByParent covers the parent index set, which
+// previously never matched because it was written with the wrapped
+// "|parentID|" form but queried with the bare parent id.
+func TestRedisCacheGetObjectsByParent(t *testing.T) {
+	cache := newTestRedisCache(t)
+
+	root := "root-" + uuid.New().String()
+	other := "other-" + uuid.New().String()
+	child1 := &APIObject{ObjectID: "child1-" + uuid.New().String(), Name: "a.txt", Parents: fmt.Sprintf("|%v|", root)}
+	child2 := &APIObject{ObjectID: "child2-" + uuid.New().String(), Name: "b.txt", Parents: fmt.Sprintf("|%v|", other)}
+	t.Cleanup(func() {
+		cache.DeleteObject(child1.ObjectID)
+		cache.DeleteObject(child2.ObjectID)
+	})
+
+	if err := cache.UpdateObject(child1); nil != err {
+		t.Fatalf("could not store object: %v", err)
+	}
+	if err := cache.UpdateObject(child2); nil != err {
+		t.Fatalf("could not store object: %v", err)
+	}
+
+	objects, err := cache.GetObjectsByParent(root)
+	if nil != err {
+		t.Fatalf("GetObjectsByParent returned an error: %v", err)
+	}
+	if 1 != len(objects) || child1.ObjectID != objects[0].ObjectID {
+		t.Fatalf("expected only child1 under root, got %v", objects)
+	}
+
+	object, err := cache.GetObjectByParentAndName(root, "a.txt")
+	if nil != err {
+		t.Fatalf("GetObjectByParentAndName returned an error: %v", err)
+	}
+	if child1.ObjectID != object.ObjectID {
+		t.Fatalf("expected child1, got %v", object.ObjectID)
+	}
+}
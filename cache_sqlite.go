@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"golang.org/x/oauth2"
+)
+
+// SqliteCache is the default cache backend. It keeps the working set in an
+// in-memory SQLite database and persists it via a write-ahead journal that
+// Backup periodically compacts into an on-disk snapshot.
+type SqliteCache struct {
+	db        *gorm.DB
+	tx        *gorm.DB
+	backup    *gorm.DB
+	journal   *cacheJournal
+	dbAction  chan cacheAction
+	tokensDir string
+	purgeHook func(objectID string)
+}
+
+// SetPurgeHook registers a function to be called with an object's id
+// whenever DeleteObject or UpdateObject changes it
+func (c *SqliteCache) SetPurgeHook(hook func(objectID string)) {
+	c.purgeHook = hook
+}
+
+// NewSqliteCache creates a new SQLite backed cache instance
+func NewSqliteCache(cacheBasePath string, sqlDebug bool) (*SqliteCache, error) {
+	Log.Debugf("Opening cache connection")
+	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache database")
+	}
+	backupPath := filepath.Join(cacheBasePath, "cache")
+	backupDb, err := gorm.Open("sqlite3", backupPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache backup database")
+	}
+	journal, err := openCacheJournal(filepath.Join(cacheBasePath, "cache.journal"))
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache journal")
+	}
+
+	Log.Debugf("Migrating cache schema")
+	db.AutoMigrate(&APIObject{})
+	db.AutoMigrate(&PageToken{})
+	db.AutoMigrate(&PendingOp{})
+	db.LogMode(sqlDebug)
+	backupDb.AutoMigrate(&APIObject{})
+	backupDb.AutoMigrate(&PageToken{})
+	backupDb.AutoMigrate(&PendingOp{})
+	backupDb.LogMode(sqlDebug)
+
+	cache := SqliteCache{
+		db:        db,
+		backup:    backupDb,
+		journal:   journal,
+		dbAction:  make(chan cacheAction),
+		tokensDir: filepath.Join(cacheBasePath, "tokens"),
+	}
+
+	var count int64
+	backupDb.Model(&APIObject{}).Count(&count)
+	if count > 0 {
+		copyDatabase(backupDb, db)
+		Log.Infof("Imported cached data from %v", backupPath)
+	}
+	if err := journal.Replay(func(action cacheAction) {
+		applyCacheAction(db, action)
+	}); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not replay cache journal")
+	}
+
+	go cache.startStoringQueue()
+
+	return &cache, nil
+}
+
+func (c *SqliteCache) startStoringQueue() {
+	for action := range c.dbAction {
+		if nil != action.object {
+			applyCacheAction(c.tx, action)
+			if err := c.journal.Append(action); nil != err {
+				Log.Debugf("%v", err)
+			}
+		}
+	}
+}
+
+func applyCacheAction(db *gorm.DB, action cacheAction) {
+	if action.action == DeleteAction || action.action == StoreAction {
+		Log.Debugf("Deleting object %v", action.object.ObjectID)
+		db.Unscoped().Delete(action.object)
+	}
+	if action.action == StoreAction {
+		Log.Debugf("Storing object %v in cache", action.object.ObjectID)
+		db.Unscoped().Create(action.object)
+	}
+}
+
+// StartTransaction starts a new transaction
+func (c *SqliteCache) StartTransaction() {
+	c.tx = c.db.Begin()
+}
+
+// EndTransaction ends the current transaction
+func (c *SqliteCache) EndTransaction() {
+	c.tx.Commit()
+}
+
+// journalCompactThreshold is how large the write-ahead journal may grow, in
+// bytes, before Backup snapshots the database and compacts it
+const journalCompactThreshold = 16 * 1024 * 1024
+
+// Backup snapshots the in-memory cache to the on-disk backup database and
+// compacts the write-ahead journal, once it has grown past journalCompactThreshold
+func (c *SqliteCache) Backup() {
+	size, err := c.journal.Size()
+	if nil != err {
+		Log.Debugf("%v", err)
+	}
+	if size < journalCompactThreshold {
+		Log.Debugf("Cache journal is %v bytes, skipping full backup", size)
+		return
+	}
+
+	Log.Debugf("Backup cache database")
+	copyDatabase(c.db, c.backup)
+	if err := c.journal.Compact(); nil != err {
+		Log.Debugf("%v", err)
+	}
+}
+
+// Close closes all handles
+func (c *SqliteCache) Close() error {
+	Log.Debugf("Closing cache connection")
+
+	close(c.dbAction)
+	if err := c.db.Close(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not close cache connection")
+	}
+	if err := c.backup.Close(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not close cache backup connection")
+	}
+	if err := c.journal.Close(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not close cache journal")
+	}
+
+	return nil
+}
+
+// LoadToken loads the given driver's token from cache
+func (c *SqliteCache) LoadToken(driver string) (*oauth2.Token, error) {
+	Log.Debugf("Loading token for %v from cache", driver)
+
+	tokenPath := c.tokenPath(driver)
+	tokenFile, err := ioutil.ReadFile(tokenPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read token file in %v", tokenPath)
+	}
+
+	var token oauth2.Token
+	json.Unmarshal(tokenFile, &token)
+
+	Log.Tracef("Got token from cache %v", token)
+
+	return &token, nil
+}
+
+// StoreToken stores the given driver's token in the cache or updates the
+// existing token file
+func (c *SqliteCache) StoreToken(driver string, token *oauth2.Token) error {
+	Log.Debugf("Storing token for %v to cache", driver)
+
+	tokenJSON, err := json.Marshal(token)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json content")
+	}
+
+	tokenPath := c.tokenPath(driver)
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0755); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not create token directory for %v", driver)
+	}
+	if err := ioutil.WriteFile(tokenPath, tokenJSON, 0644); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json file")
+	}
+
+	return nil
+}
+
+// tokenPath returns the per-driver token file path
+func (c *SqliteCache) tokenPath(driver string) string {
+	return filepath.Join(c.tokensDir, driver+".json")
+}
+
+// GetObject gets an object by id, overlaid with any pending rename/delete
+// staged against it
+func (c *SqliteCache) GetObject(id string) (*APIObject, error) {
+	Log.Tracef("Getting object %v", id)
+
+	var object APIObject
+	c.db.Where(&APIObject{ObjectID: id}).First(&object)
+
+	if "" == object.ObjectID {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+
+	var pending []*PendingOp
+	c.db.Where(&PendingOp{ObjectID: id}).Find(&pending)
+	overlaid := overlayPendingOnObject(&object, pending)
+	if nil == overlaid {
+		return nil, fmt.Errorf("Could not find object %v in cache", id)
+	}
+
+	Log.Tracef("Got object from cache %v", overlaid)
+	return overlaid, nil
+}
+
+// GetObjectsByParent get all objects under parent id, overlaid with any
+// pending creates/renames/deletes staged under that parent
+func (c *SqliteCache) GetObjectsByParent(parent string) ([]*APIObject, error) {
+	Log.Tracef("Getting children for %v", parent)
+
+	var objects []*APIObject
+	c.db.Where("parents LIKE ?", fmt.Sprintf("%%|%v|%%", parent)).Find(&objects)
+
+	var pending []*PendingOp
+	c.db.Where(&PendingOp{ParentID: parent}).Find(&pending)
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	Log.Tracef("Got objects from cache %v", objects)
+
+	if 0 != len(objects) {
+		return objects, nil
+	}
+
+	return nil, fmt.Errorf("Could not find children for parent %v in cache", parent)
+}
+
+// GetObjectByParentAndName finds a child element by name and its parent id
+func (c *SqliteCache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
+	Log.Tracef("Getting object %v in parent %v", name, parent)
+
+	var objects []*APIObject
+	var disk APIObject
+	c.db.Where("parents LIKE ? AND name = ?", fmt.Sprintf("%%|%v|%%", parent), name).First(&disk)
+	if "" != disk.ObjectID {
+		objects = append(objects, &disk)
+	}
+
+	var pending []*PendingOp
+	c.db.Where(&PendingOp{ParentID: parent}).Find(&pending)
+	objects = overlayPendingOnChildren(objects, parent, pending)
+
+	for _, object := range objects {
+		if object.Name == name {
+			Log.Tracef("Got object from cache %v", object)
+			return object, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+}
+
+// DeleteObject deletes an object by id
+func (c *SqliteCache) DeleteObject(id string) error {
+	c.dbAction <- cacheAction{
+		action: DeleteAction,
+		object: &APIObject{ObjectID: id},
+	}
+	if nil != c.purgeHook {
+		c.purgeHook(id)
+	}
+	return nil
+}
+
+// UpdateObject updates an object
+func (c *SqliteCache) UpdateObject(object *APIObject) error {
+	c.dbAction <- cacheAction{
+		action: StoreAction,
+		object: object,
+	}
+	if nil != c.purgeHook {
+		c.purgeHook(object.ObjectID)
+	}
+	return nil
+}
+
+// StoreStartPageToken stores driver's page token for changes
+func (c *SqliteCache) StoreStartPageToken(driver, token string) error {
+	Log.Debugf("Storing page token %v for %v in cache", token, driver)
+
+	c.tx.Unscoped().Where(&PageToken{Driver: driver}).Delete(&PageToken{})
+	c.tx.Unscoped().Create(&PageToken{
+		Driver: driver,
+		Token:  token,
+	})
+
+	return nil
+}
+
+// GetStartPageToken gets driver's start page token
+func (c *SqliteCache) GetStartPageToken(driver string) (string, error) {
+	Log.Debugf("Getting start page token for %v from cache", driver)
+
+	var pageToken PageToken
+	c.db.Where(&PageToken{Driver: driver}).First(&pageToken)
+
+	Log.Tracef("Got start page token %v", pageToken.Token)
+
+	if "" == pageToken.Token {
+		return "", fmt.Errorf("Token not found in cache for %v", driver)
+	}
+
+	return pageToken.Token, nil
+}
+
+func copyDatabase(src *gorm.DB, dest *gorm.DB) {
+	tx := dest.Begin()
+
+	// delete old data
+	tx.Unscoped().Delete(&PageToken{})
+	tx.Unscoped().Delete(&APIObject{})
+	tx.Unscoped().Delete(&PendingOp{})
+
+	// copy page tokens, one per driver
+	var tokens []*PageToken
+	src.Find(&tokens)
+	for _, token := range tokens {
+		tx.Unscoped().Create(token)
+	}
+
+	// copy objects
+	var objects []*APIObject
+	src.Find(&objects)
+	for _, object := range objects {
+		tx.Unscoped().Create(object)
+	}
+
+	// copy pending operations
+	var pending []*PendingOp
+	src.Find(&pending)
+	for _, op := range pending {
+		tx.Unscoped().Create(op)
+	}
+
+	tx.Commit()
+}
+
+// EnqueuePending stages a write-back operation for the uploader to pick up
+func (c *SqliteCache) EnqueuePending(op *PendingOp) error {
+	if "" == op.ID {
+		op.ID = uuid.New().String()
+	}
+	if op.CreatedAt.IsZero() {
+		op.CreatedAt = time.Now()
+	}
+
+	Log.Debugf("Enqueuing pending %v for %v", op.Op, op.ObjectID)
+	return c.db.Create(op).Error
+}
+
+// NextPending returns the oldest pending operation that is still awaiting
+// upload and not currently backing off from a previous failure
+func (c *SqliteCache) NextPending() (*PendingOp, error) {
+	var op PendingOp
+	c.db.Where("failed = ? AND next_attempt_at <= ?", false, time.Now()).Order("created_at asc").First(&op)
+
+	if "" == op.ID {
+		return nil, fmt.Errorf("No pending operations in cache")
+	}
+	return &op, nil
+}
+
+// CompletePending removes a pending operation once it has been applied to
+// the storage backend
+func (c *SqliteCache) CompletePending(id string) error {
+	Log.Debugf("Completing pending operation %v", id)
+	return c.db.Unscoped().Delete(&PendingOp{ID: id}).Error
+}
+
+// FailPending records a failed upload attempt against a pending operation
+func (c *SqliteCache) FailPending(id string, cause error) error {
+	Log.Debugf("Pending operation %v failed: %v", id, cause)
+
+	var op PendingOp
+	c.db.Where(&PendingOp{ID: id}).First(&op)
+	if "" == op.ID {
+		return fmt.Errorf("Could not find pending operation %v in cache", id)
+	}
+
+	op.Attempts++
+	op.LastError = cause.Error()
+	op.NextAttemptAt = time.Now().Add(backoffDuration(op.Attempts))
+	if op.Attempts >= uploaderMaxAttempts {
+		op.Failed = true
+	}
+
+	return c.db.Save(&op).Error
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/google/uuid"
+)
+
+const (
+	// driveWatchChannelTTL is the maximum lifetime Google grants a Drive
+	// Changes watch channel before it must be re-registered
+	driveWatchChannelTTL = 24 * time.Hour
+	// driveWatchChannelRenewBefore renews the channel a bit ahead of its
+	// expiration so a late renewal never leaves a gap uncovered
+	driveWatchChannelRenewBefore = 1 * time.Hour
+
+	// longPollInterval is how often ChangeNotifier falls back to pulling
+	// the change feed itself when no notification address is configured
+	longPollInterval = 30 * time.Second
+)
+
+// ChangeNotifier keeps the metadata cache close to real time by registering
+// a Drive Changes watch channel and reacting to its push notifications,
+// falling back to long-polling if no notification address is configured
+type ChangeNotifier struct {
+	drive    *Drive
+	cache    Cache
+	onChange func()
+
+	addr    string
+	tlsCert string
+	tlsKey  string
+
+	mutex      sync.Mutex
+	channelID  string
+	resourceID string
+	expiresAt  time.Time
+
+	server *http.Server
+}
+
+// NewChangeNotifier creates a notifier for drive's change feed. addr is the
+// address to listen on for Drive's webhook callbacks; if empty, Start falls
+// back to long-polling. tlsCert/tlsKey are an optional TLS certificate pair.
+func NewChangeNotifier(drive *Drive, cache Cache, addr, tlsCert, tlsKey string, onChange func()) *ChangeNotifier {
+	return &ChangeNotifier{
+		drive:    drive,
+		cache:    cache,
+		onChange: onChange,
+		addr:     addr,
+		tlsCert:  tlsCert,
+		tlsKey:   tlsKey,
+	}
+}
+
+// Start registers the watch channel, or starts long-polling if no
+// notification address was configured, and begins renewing it as it nears expiry
+func (n *ChangeNotifier) Start() error {
+	if "" == n.addr {
+		Log.Infof("No notification address configured, falling back to long-polling for changes")
+		go n.longPoll()
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", n.handleNotification)
+	n.server = &http.Server{Addr: n.addr, Handler: mux}
+
+	go func() {
+		var err error
+		if "" != n.tlsCert {
+			err = n.server.ListenAndServeTLS(n.tlsCert, n.tlsKey)
+		} else {
+			err = n.server.ListenAndServe()
+		}
+		if nil != err && http.ErrServerClosed != err {
+			Log.Debugf("%v", err)
+		}
+	}()
+
+	if err := n.registerChannel(); nil != err {
+		return err
+	}
+
+	go n.renewLoop()
+
+	return nil
+}
+
+// Stop stops the notification webhook and its Drive watch channel, if registered
+func (n *ChangeNotifier) Stop() error {
+	n.mutex.Lock()
+	channelID, resourceID := n.channelID, n.resourceID
+	n.mutex.Unlock()
+
+	if "" != channelID {
+		if err := n.drive.StopChannel(channelID, resourceID); nil != err {
+			Log.Debugf("%v", err)
+		}
+	}
+
+	if nil != n.server {
+		return n.server.Shutdown(context.Background())
+	}
+	return nil
+}
+
+func (n *ChangeNotifier) registerChannel() error {
+	channelID := uuid.New().String()
+	scheme := "http"
+	if "" != n.tlsCert {
+		scheme = "https"
+	}
+	callbackURL := fmt.Sprintf("%v://%v/notify", scheme, n.addr)
+
+	resourceID, expiresAt, err := n.drive.WatchChanges(channelID, callbackURL, driveWatchChannelTTL)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not register Drive watch channel")
+	}
+
+	n.mutex.Lock()
+	n.channelID = channelID
+	n.resourceID = resourceID
+	n.expiresAt = expiresAt
+	n.mutex.Unlock()
+
+	Log.Infof("Registered Drive watch channel %v, expires %v", channelID, expiresAt)
+	return nil
+}
+
+func (n *ChangeNotifier) renewLoop() {
+	for {
+		n.mutex.Lock()
+		expiresAt := n.expiresAt
+		n.mutex.Unlock()
+
+		sleep := time.Until(expiresAt) - driveWatchChannelRenewBefore
+		if sleep < 0 {
+			sleep = 0
+		}
+		time.Sleep(sleep)
+
+		if err := n.registerChannel(); nil != err {
+			Log.Debugf("%v", err)
+			time.Sleep(time.Minute)
+		}
+	}
+}
+
+func (n *ChangeNotifier) handleNotification(w http.ResponseWriter, r *http.Request) {
+	channelID := r.Header.Get("X-Goog-Channel-ID")
+	resourceState := r.Header.Get("X-Goog-Resource-State")
+
+	n.mutex.Lock()
+	expected := n.channelID
+	n.mutex.Unlock()
+
+	if channelID != expected {
+		Log.Debugf("Ignoring notification for unknown channel %v", channelID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	Log.Debugf("Got Drive notification for channel %v, state %v", channelID, resourceState)
+	if "sync" != resourceState {
+		n.onChange()
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *ChangeNotifier) longPoll() {
+	for range time.Tick(longPollInterval) {
+		n.onChange()
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+	drivev3 "google.golang.org/api/drive/v3"
+)
+
+// driveFileFields is the set of Drive API file fields needed to populate an APIObject
+const driveFileFields = "id, name, mimeType, size, modifiedTime, webContentLink, parents"
+
+// Drive is the Google Drive API v3 client shared by DriveDriver and ChangeNotifier
+type Drive struct {
+	cache      Cache
+	oauthConf  *oauth2.Config
+	httpClient *http.Client
+	service    *drivev3.Service
+}
+
+// NewDriveClient creates a Drive client for oauthConf, loading a persisted
+// token if one exists; otherwise Authorize must be called first
+func NewDriveClient(oauthConf *oauth2.Config, cache Cache) (*Drive, error) {
+	d := &Drive{cache: cache, oauthConf: oauthConf}
+
+	if token, err := cache.LoadToken(DriveDriverType); nil == err {
+		if err := d.authorizeWithToken(token); nil != err {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func (d *Drive) authorizeWithToken(token *oauth2.Token) error {
+	httpClient := d.oauthConf.Client(oauth2.NoContext, token)
+	service, err := drivev3.New(httpClient)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not create Google Drive API client")
+	}
+	d.httpClient = httpClient
+	d.service = service
+	return nil
+}
+
+// Authorize runs the OAuth2 token exchange and returns the resulting token
+// so the caller (DriveDriver.Auth) can persist it
+func (d *Drive) Authorize() (*oauth2.Token, error) {
+	token, err := d.oauthConf.Exchange(oauth2.NoContext, d.oauthConf.Endpoint.AuthURL)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not authorize Google Drive client")
+	}
+	if err := d.authorizeWithToken(token); nil != err {
+		return nil, err
+	}
+	return token, nil
+}
+
+func driveFileToObject(file *drivev3.File) *APIObject {
+	modified, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+
+	parents := "|"
+	for _, parentID := range file.Parents {
+		parents += parentID + "|"
+	}
+
+	return &APIObject{
+		ObjectID:     file.Id,
+		Name:         file.Name,
+		IsDir:        "application/vnd.google-apps.folder" == file.MimeType,
+		Size:         uint64(file.Size),
+		LastModified: modified,
+		DownloadURL:  file.WebContentLink,
+		Parents:      parents,
+		DriverType:   DriveDriverType,
+	}
+}
+
+// GetObject fetches a single file by id
+func (d *Drive) GetObject(objectID string) (*APIObject, error) {
+	file, err := d.service.Files.Get(objectID).Fields(driveFileFields).Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Drive object %v", objectID)
+	}
+	return driveFileToObject(file), nil
+}
+
+// GetObjectsByParent lists the direct children of parentID, following
+// pagination until Drive reports no further pages
+func (d *Drive) GetObjectsByParent(parentID string) ([]*APIObject, error) {
+	var objects []*APIObject
+
+	pageToken := ""
+	for {
+		call := d.service.Files.List().
+			Q(fmt.Sprintf("'%v' in parents and trashed = false", parentID)).
+			Fields("nextPageToken, files(" + driveFileFields + ")")
+		if "" != pageToken {
+			call = call.PageToken(pageToken)
+		}
+
+		res, err := call.Do()
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not list Drive objects under %v", parentID)
+		}
+
+		for _, file := range res.Files {
+			objects = append(objects, driveFileToObject(file))
+		}
+
+		if "" == res.NextPageToken {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	return objects, nil
+}
+
+// OpenRange opens object for reading starting at offset via a ranged GET
+// against the API's media endpoint
+func (d *Drive) OpenRange(object *APIObject, offset int64) (io.ReadCloser, error) {
+	url := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v?alt=media", object.ObjectID)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+
+	resp, err := d.httpClient.Do(req)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open Drive object %v", object.ObjectID)
+	}
+
+	return resp.Body, nil
+}
+
+// GetChanges returns the objects that changed since pageToken along with the
+// page token to resume from on the next call; removed or trashed files are omitted
+func (d *Drive) GetChanges(pageToken string) ([]*APIObject, string, error) {
+	if "" == pageToken {
+		token, err := d.service.Changes.GetStartPageToken().Do()
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, "", fmt.Errorf("Could not get Drive start page token")
+		}
+		pageToken = token.StartPageToken
+	}
+
+	var objects []*APIObject
+	for {
+		res, err := d.service.Changes.List(pageToken).
+			Fields("nextPageToken, newStartPageToken, changes(removed, fileId, file(" + driveFileFields + ", trashed))").
+			Do()
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, pageToken, fmt.Errorf("Could not get Drive changes for page token %v", pageToken)
+		}
+
+		for _, change := range res.Changes {
+			if change.Removed || nil == change.File || change.File.Trashed {
+				continue
+			}
+			objects = append(objects, driveFileToObject(change.File))
+		}
+
+		if "" != res.NewStartPageToken {
+			pageToken = res.NewStartPageToken
+		}
+		if "" == res.NextPageToken {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	return objects, pageToken, nil
+}
+
+// InsertObject uploads content as a new file named name under parentID
+func (d *Drive) InsertObject(parentID, name string, content *os.File) (*APIObject, error) {
+	file := &drivev3.File{Name: name, Parents: []string{parentID}}
+
+	created, err := d.service.Files.Create(file).Fields(driveFileFields).Media(content).Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not upload %v to Google Drive", name)
+	}
+
+	return driveFileToObject(created), nil
+}
+
+// UpdateObjectContent replaces objectID's content with content
+func (d *Drive) UpdateObjectContent(objectID string, content *os.File) error {
+	if _, err := d.service.Files.Update(objectID, &drivev3.File{}).Media(content).Do(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not update content of Drive object %v", objectID)
+	}
+	return nil
+}
+
+// RenameObject renames objectID to name and, if newParentID is set, moves it
+// there
+func (d *Drive) RenameObject(objectID, newParentID, name string) error {
+	call := d.service.Files.Update(objectID, &drivev3.File{Name: name})
+	if "" != newParentID {
+		file, err := d.service.Files.Get(objectID).Fields("parents").Do()
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not get parents of Drive object %v", objectID)
+		}
+		var oldParents []string
+		for _, parentID := range file.Parents {
+			if parentID != newParentID {
+				oldParents = append(oldParents, parentID)
+			}
+		}
+		call = call.AddParents(newParentID).RemoveParents(strings.Join(oldParents, ","))
+	}
+	if _, err := call.Do(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not rename Drive object %v", objectID)
+	}
+	return nil
+}
+
+// TrashObject moves objectID to the trash
+func (d *Drive) TrashObject(objectID string) error {
+	file := &drivev3.File{Trashed: true}
+	if _, err := d.service.Files.Update(objectID, file).Do(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not trash Drive object %v", objectID)
+	}
+	return nil
+}
+
+// WatchChanges registers a Drive Changes watch channel that delivers push
+// notifications to callbackURL until ttl elapses, returning the resource id
+// needed to stop it again and the time it actually expires at
+func (d *Drive) WatchChanges(channelID, callbackURL string, ttl time.Duration) (string, time.Time, error) {
+	startPageToken, err := d.service.Changes.GetStartPageToken().Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return "", time.Time{}, fmt.Errorf("Could not get Drive start page token")
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	channel := &drivev3.Channel{
+		Id:         channelID,
+		Type:       "web_hook",
+		Address:    callbackURL,
+		Expiration: expiresAt.UnixNano() / int64(time.Millisecond),
+	}
+
+	res, err := d.service.Changes.Watch(startPageToken.StartPageToken, channel).Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return "", time.Time{}, fmt.Errorf("Could not register Drive watch channel")
+	}
+
+	if 0 != res.Expiration {
+		expiresAt = time.Unix(0, res.Expiration*int64(time.Millisecond))
+	}
+
+	return res.ResourceId, expiresAt, nil
+}
+
+// StopChannel cancels a previously registered watch channel
+func (d *Drive) StopChannel(channelID, resourceID string) error {
+	channel := &drivev3.Channel{Id: channelID, ResourceId: resourceID}
+	if err := d.service.Channels.Stop(channel).Do(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not stop Drive watch channel %v", channelID)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// DriveDriver is the StorageDriver implementation for Google Drive
+type DriveDriver struct {
+	client     *Drive
+	cache      Cache
+	blockCache *BlockCache
+}
+
+// NewDriveDriver creates a new Google Drive storage driver. blockCache may be
+// nil, in which case Open always reads straight from Drive.
+func NewDriveDriver(client *Drive, cache Cache, blockCache *BlockCache) *DriveDriver {
+	return &DriveDriver{
+		client:     client,
+		cache:      cache,
+		blockCache: blockCache,
+	}
+}
+
+// DriverType returns DriveDriverType
+func (d *DriveDriver) DriverType() string {
+	return DriveDriverType
+}
+
+// Auth runs the OAuth2 token exchange for this Drive account and persists the
+// resulting token via Cache.StoreToken under DriveDriverType; an existing
+// token is not refreshed
+func (d *DriveDriver) Auth() error {
+	token, err := d.client.Authorize()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not authorize Google Drive driver")
+	}
+	return d.cache.StoreToken(d.DriverType(), token)
+}
+
+// List lists the direct children of parentID
+func (d *DriveDriver) List(parentID string) ([]*APIObject, error) {
+	return d.client.GetObjectsByParent(parentID)
+}
+
+// Open opens objectID for reading starting at offset, serving blocks from
+// the block cache when one is configured
+func (d *DriveDriver) Open(objectID string, offset int64) (io.ReadCloser, error) {
+	object, err := d.client.GetObject(objectID)
+	if nil != err {
+		return nil, err
+	}
+
+	if nil != d.blockCache {
+		return d.blockCache.Open(objectID, offset, func(start int64) (io.ReadCloser, error) {
+			return d.client.OpenRange(object, start)
+		}), nil
+	}
+
+	return d.client.OpenRange(object, offset)
+}
+
+// Changes returns the objects that changed since pageToken along with the
+// page token to resume from on the next call
+func (d *DriveDriver) Changes(pageToken string) ([]*APIObject, string, error) {
+	return d.client.GetChanges(pageToken)
+}
+
+// Create uploads content as a new object named name under parentID
+func (d *DriveDriver) Create(parentID, name string, content *os.File) (*APIObject, error) {
+	object, err := d.client.InsertObject(parentID, name, content)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not upload %v to Google Drive", name)
+	}
+	return object, nil
+}
+
+// Update replaces objectID's content on Drive
+func (d *DriveDriver) Update(objectID string, content *os.File) error {
+	if err := d.client.UpdateObjectContent(objectID, content); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not upload new content for %v to Google Drive", objectID)
+	}
+	return nil
+}
+
+// Rename moves/renames objectID to name under newParentID on Drive
+func (d *DriveDriver) Rename(objectID, newParentID, name string) error {
+	if err := d.client.RenameObject(objectID, newParentID, name); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not rename %v on Google Drive", objectID)
+	}
+	return nil
+}
+
+// Delete removes objectID from Drive
+func (d *DriveDriver) Delete(objectID string) error {
+	if err := d.client.TrashObject(objectID); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete %v from Google Drive", objectID)
+	}
+	return nil
+}
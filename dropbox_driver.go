@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+)
+
+const (
+	dropboxAPIBaseURL     = "https://api.dropboxapi.com/2"
+	dropboxContentBaseURL = "https://content.dropboxapi.com/2"
+)
+
+// DropboxDriver is the StorageDriver implementation for Dropbox, talking to
+// the Dropbox API directly over HTTP
+type DropboxDriver struct {
+	httpClient *http.Client
+	cache      Cache
+	oauthConf  *oauth2.Config
+	blockCache *BlockCache
+}
+
+// NewDropboxDriver creates a new Dropbox storage driver authenticated with
+// oauthConf. blockCache may be nil, in which case Open always reads straight from Dropbox.
+func NewDropboxDriver(oauthConf *oauth2.Config, cache Cache, blockCache *BlockCache) (*DropboxDriver, error) {
+	token, err := cache.LoadToken(DropboxDriverType)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not load Dropbox token, run Auth first")
+	}
+
+	return &DropboxDriver{
+		httpClient: oauthConf.Client(oauth2.NoContext, token),
+		cache:      cache,
+		oauthConf:  oauthConf,
+		blockCache: blockCache,
+	}, nil
+}
+
+// DriverType returns DropboxDriverType
+func (d *DropboxDriver) DriverType() string {
+	return DropboxDriverType
+}
+
+// Auth performs the OAuth2 token exchange and persists the resulting token
+func (d *DropboxDriver) Auth() error {
+	token, err := d.oauthConf.Exchange(oauth2.NoContext, d.oauthConf.Endpoint.AuthURL)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not authorize Dropbox driver")
+	}
+	return d.cache.StoreToken(d.DriverType(), token)
+}
+
+type dropboxListFolderEntry struct {
+	Tag            string `json:".tag"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	PathLower      string `json:"path_lower"`
+	Size           uint64 `json:"size"`
+	ServerModified string `json:"server_modified"`
+}
+
+type dropboxListFolderResponse struct {
+	Entries []dropboxListFolderEntry `json:"entries"`
+	Cursor  string                   `json:"cursor"`
+	HasMore bool                     `json:"has_more"`
+}
+
+// List lists the direct children of parentID via /2/files/list_folder
+func (d *DropboxDriver) List(parentID string) ([]*APIObject, error) {
+	Log.Debugf("Listing Dropbox folder %v", parentID)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"path":      parentID,
+		"recursive": false,
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	listResp, err := d.doListFolder(dropboxAPIBaseURL+"/files/list_folder", bytes.NewReader(body))
+	if nil != err {
+		return nil, fmt.Errorf("Could not list Dropbox folder %v", parentID)
+	}
+
+	var objects []*APIObject
+	for {
+		for _, entry := range listResp.Entries {
+			modified, _ := time.Parse(time.RFC3339, entry.ServerModified)
+			objects = append(objects, &APIObject{
+				ObjectID:     entry.ID,
+				Name:         entry.Name,
+				IsDir:        "folder" == entry.Tag,
+				Size:         entry.Size,
+				LastModified: modified,
+				Parents:      "|" + parentID + "|",
+				DriverType:   d.DriverType(),
+			})
+		}
+
+		if !listResp.HasMore {
+			break
+		}
+
+		cursorBody, err := json.Marshal(map[string]string{"cursor": listResp.Cursor})
+		if nil != err {
+			return nil, err
+		}
+
+		listResp, err = d.doListFolder(dropboxAPIBaseURL+"/files/list_folder/continue", bytes.NewReader(cursorBody))
+		if nil != err {
+			return nil, fmt.Errorf("Could not continue listing Dropbox folder %v", parentID)
+		}
+	}
+
+	return objects, nil
+}
+
+// doListFolder posts to a Dropbox list_folder (or list_folder/continue)
+// endpoint and decodes the response, surfacing non-2xx statuses as errors
+func (d *DropboxDriver) doListFolder(url string, body io.Reader) (*dropboxListFolderResponse, error) {
+	resp, err := d.httpClient.Post(url, "application/json", body)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Dropbox API returned status %v", resp.StatusCode)
+	}
+
+	var listResp dropboxListFolderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&listResp); nil != err {
+		return nil, err
+	}
+
+	return &listResp, nil
+}
+
+// Open opens objectID for reading starting at offset via /2/files/download,
+// serving blocks from the block cache when one is configured
+func (d *DropboxDriver) Open(objectID string, offset int64) (io.ReadCloser, error) {
+	if nil != d.blockCache {
+		return d.blockCache.Open(objectID, offset, func(start int64) (io.ReadCloser, error) {
+			return d.openRange(objectID, start)
+		}), nil
+	}
+	return d.openRange(objectID, offset)
+}
+
+func (d *DropboxDriver) openRange(objectID string, offset int64) (io.ReadCloser, error) {
+	Log.Debugf("Opening Dropbox object %v at offset %v", objectID, offset)
+
+	args, err := json.Marshal(map[string]string{"path": objectID})
+	if nil != err {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", dropboxContentBaseURL+"/files/download", nil)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Dropbox-API-Arg", string(args))
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+
+	resp, err := d.httpClient.Do(req)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not download Dropbox object %v", objectID)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Dropbox API returned status %v for object %v", resp.StatusCode, objectID)
+	}
+
+	return resp.Body, nil
+}
+
+// Changes is not yet supported for Dropbox
+func (d *DropboxDriver) Changes(pageToken string) ([]*APIObject, string, error) {
+	return nil, pageToken, fmt.Errorf("Change feed is not yet supported for the Dropbox driver")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/claudetech/loggo/default"
+)
+
+// S3Driver is the StorageDriver implementation for S3-compatible object
+// storage; List synthesizes a folder tree from "/" delimited key prefixes
+type S3Driver struct {
+	client     *s3.S3
+	bucket     string
+	blockCache *BlockCache
+}
+
+// NewS3Driver creates a new S3-compatible storage driver. endpoint may be
+// empty to use AWS's default S3 endpoint. blockCache may be nil, in which
+// case Open always reads straight from the bucket.
+func NewS3Driver(bucket, region, endpoint string, blockCache *BlockCache) (*S3Driver, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(region),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool("" != endpoint),
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create S3 session for bucket %v", bucket)
+	}
+
+	return &S3Driver{
+		client:     s3.New(sess),
+		bucket:     bucket,
+		blockCache: blockCache,
+	}, nil
+}
+
+// DriverType returns S3DriverType
+func (d *S3Driver) DriverType() string {
+	return S3DriverType
+}
+
+// Auth is a no-op for S3Driver: authentication is handled by the AWS SDK's
+// standard credential chain
+func (d *S3Driver) Auth() error {
+	return nil
+}
+
+// List lists the objects and synthesized subdirectories directly under the
+// parentID prefix
+func (d *S3Driver) List(parentID string) ([]*APIObject, error) {
+	prefix := parentID
+	if "" != prefix && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	Log.Debugf("Listing S3 objects under prefix %v", prefix)
+
+	var objects []*APIObject
+	var continuationToken *string
+	for {
+		output, err := d.client.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(d.bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: continuationToken,
+		})
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not list S3 objects under %v", prefix)
+		}
+
+		for _, commonPrefix := range output.CommonPrefixes {
+			key := strings.TrimSuffix(*commonPrefix.Prefix, "/")
+			objects = append(objects, &APIObject{
+				ObjectID:   key,
+				Name:       key[strings.LastIndex(key, "/")+1:],
+				IsDir:      true,
+				Parents:    "|" + parentID + "|",
+				DriverType: d.DriverType(),
+			})
+		}
+		for _, object := range output.Contents {
+			objects = append(objects, &APIObject{
+				ObjectID:     *object.Key,
+				Name:         (*object.Key)[strings.LastIndex(*object.Key, "/")+1:],
+				IsDir:        false,
+				Size:         uint64(*object.Size),
+				LastModified: *object.LastModified,
+				Parents:      "|" + parentID + "|",
+				DriverType:   d.DriverType(),
+			})
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+// Open opens objectID for reading starting at offset via a ranged GetObject,
+// serving blocks from the block cache when one is configured
+func (d *S3Driver) Open(objectID string, offset int64) (io.ReadCloser, error) {
+	if nil != d.blockCache {
+		return d.blockCache.Open(objectID, offset, func(start int64) (io.ReadCloser, error) {
+			return d.openRange(objectID, start)
+		}), nil
+	}
+	return d.openRange(objectID, offset)
+}
+
+func (d *S3Driver) openRange(objectID string, offset int64) (io.ReadCloser, error) {
+	Log.Debugf("Opening S3 object %v at offset %v", objectID, offset)
+
+	output, err := d.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(objectID),
+		Range:  aws.String(fmt.Sprintf("bytes=%v-", offset)),
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open S3 object %v", objectID)
+	}
+
+	return output.Body, nil
+}
+
+// Changes is not supported for S3Driver: S3 has no native change feed
+func (d *S3Driver) Changes(pageToken string) ([]*APIObject, string, error) {
+	return nil, pageToken, fmt.Errorf("Change feed is not supported for the S3 driver")
+}
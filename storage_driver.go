@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+)
+
+// Storage driver type discriminators, persisted on APIObject.DriverType so
+// objects from several mounted drivers can coexist in one cache
+const (
+	// DriveDriverType identifies objects that came from Google Drive
+	DriveDriverType = "drive"
+	// DropboxDriverType identifies objects that came from Dropbox
+	DropboxDriverType = "dropbox"
+	// S3DriverType identifies objects that came from an S3-compatible bucket
+	S3DriverType = "s3"
+)
+
+// StorageDriver is implemented by every supported cloud backend. It is the
+// seam that lets plexdrive mount more than one kind of cloud source under a
+// single FUSE tree, with the Cache staying backend-agnostic.
+type StorageDriver interface {
+	// DriverType returns the discriminator this driver stores on the
+	// objects it produces, e.g. DriveDriverType
+	DriverType() string
+	// Auth performs (or refreshes) authentication for this driver,
+	// persisting its token via Cache.StoreToken under its DriverType
+	Auth() error
+	// List lists the direct children of parentID
+	List(parentID string) ([]*APIObject, error)
+	// Open opens objectID for reading starting at offset
+	Open(objectID string, offset int64) (io.ReadCloser, error)
+	// Changes returns the objects that changed since pageToken along with
+	// the page token to resume from on the next call
+	Changes(pageToken string) (changes []*APIObject, nextPageToken string, err error)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	uploaderBaseBackoff = 5 * time.Second
+	uploaderMaxBackoff  = 5 * time.Minute
+	uploaderMaxAttempts = 10
+)
+
+// WritableStorageDriver is implemented by drivers that support write-back uploads
+type WritableStorageDriver interface {
+	StorageDriver
+
+	// Create uploads a new object named name under parentID
+	Create(parentID, name string, content *os.File) (*APIObject, error)
+	// Update replaces objectID's content
+	Update(objectID string, content *os.File) error
+	// Rename moves/renames objectID to name under newParentID
+	Rename(objectID, newParentID, name string) error
+	// Delete removes objectID
+	Delete(objectID string) error
+}
+
+// Uploader drains the Cache's pending operation queue against a
+// WritableStorageDriver, retrying failures with exponential backoff
+type Uploader struct {
+	cache     Cache
+	driver    WritableStorageDriver
+	spoolPath string
+	stop      chan struct{}
+}
+
+// NewUploader creates an uploader that drains cache's pending queue against driver
+func NewUploader(cache Cache, driver WritableStorageDriver, spoolPath string) *Uploader {
+	return &Uploader{
+		cache:     cache,
+		driver:    driver,
+		spoolPath: spoolPath,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start begins draining the pending queue in the background
+func (u *Uploader) Start() {
+	go u.run()
+}
+
+// Stop stops the background drain loop
+func (u *Uploader) Stop() {
+	close(u.stop)
+}
+
+func (u *Uploader) run() {
+	for {
+		select {
+		case <-u.stop:
+			return
+		default:
+		}
+
+		op, err := u.cache.NextPending()
+		if nil != err {
+			time.Sleep(uploaderBaseBackoff)
+			continue
+		}
+
+		if err := u.process(op); nil != err {
+			Log.Debugf("%v", err)
+			if op.Attempts+1 >= uploaderMaxAttempts {
+				Log.Errorf("Giving up on pending operation %v after %v attempts, leaving it parked for manual recovery: %v", op.ID, op.Attempts+1, err)
+			}
+			u.cache.FailPending(op.ID, err)
+			continue
+		}
+
+		u.cache.CompletePending(op.ID)
+		u.cleanupSpool(op)
+	}
+}
+
+// cleanupSpool removes the staged local file backing a completed create or update
+func (u *Uploader) cleanupSpool(op *PendingOp) {
+	if PendingCreate != op.Op && PendingUpdate != op.Op {
+		return
+	}
+	if err := os.Remove(filepath.Join(u.spoolPath, op.ID)); nil != err && !os.IsNotExist(err) {
+		Log.Debugf("Could not remove spooled file for pending operation %v: %v", op.ID, err)
+	}
+}
+
+// backoffDuration returns the delay before retrying an operation that has
+// already failed attempts times, doubling up to uploaderMaxBackoff
+func backoffDuration(attempts int) time.Duration {
+	backoff := uploaderBaseBackoff * time.Duration(math.Pow(2, float64(attempts)))
+	if backoff > uploaderMaxBackoff {
+		return uploaderMaxBackoff
+	}
+	return backoff
+}
+
+func (u *Uploader) process(op *PendingOp) error {
+	switch op.Op {
+	case PendingCreate, PendingUpdate:
+		content, err := os.Open(filepath.Join(u.spoolPath, op.ID))
+		if nil != err {
+			return fmt.Errorf("Could not open spooled file for pending operation %v", op.ID)
+		}
+		defer content.Close()
+
+		if PendingCreate == op.Op {
+			object, err := u.driver.Create(op.ParentID, filepath.Base(op.LocalPath), content)
+			if nil != err {
+				return err
+			}
+			return u.cache.UpdateObject(object)
+		}
+
+		if err := u.driver.Update(op.ObjectID, content); nil != err {
+			return err
+		}
+		object, err := u.cache.GetObject(op.ObjectID)
+		if nil != err {
+			return err
+		}
+		info, err := content.Stat()
+		if nil != err {
+			return err
+		}
+		object.Size = uint64(info.Size())
+		object.LastModified = info.ModTime()
+		return u.cache.UpdateObject(object)
+	case PendingRename:
+		if err := u.driver.Rename(op.ObjectID, op.ParentID, filepath.Base(op.LocalPath)); nil != err {
+			return err
+		}
+		object, err := u.cache.GetObject(op.ObjectID)
+		if nil != err {
+			return err
+		}
+		object.Name = filepath.Base(op.LocalPath)
+		object.Parents = "|" + op.ParentID + "|"
+		return u.cache.UpdateObject(object)
+	case PendingDelete:
+		if err := u.driver.Delete(op.ObjectID); nil != err {
+			return err
+		}
+		return u.cache.DeleteObject(op.ObjectID)
+	default:
+		return fmt.Errorf("Unknown pending operation kind %v", op.Op)
+	}
+}